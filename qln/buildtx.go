@@ -17,12 +17,24 @@ import (
 // The PKH addresses are my refund base with their r-elkrem point, and
 // their refund base with my r-elkrem point.  "Their" point means they have
 // the point but not the scalar.
-func (q *Qchan) SimpleCloseTx() (*wire.MsgTx, error) {
+// feeRate is in sat/vByte; if it's <= 0, q.FeeEst is asked for a rate,
+// falling back to DefaultFeeRate if that's unset or errors.
+func (q *Qchan) SimpleCloseTx(feeRate int64) (*wire.MsgTx, error) {
 	// sanity checks
 	if q == nil || q.State == nil {
 		return nil, fmt.Errorf("SimpleCloseTx: nil chan / state")
 	}
-	fee := int64(5000) // fixed fee for now (on both sides)
+	feeRate = q.feeRateOrDefault(feeRate)
+	fee := q.txVSize(2*p2wpkhOutSize) * feeRate
+
+	myAmt := q.State.MyAmt
+	theirAmt := q.Value - q.State.MyAmt
+	myFee, theirFee := splitFee(fee, myAmt, theirAmt)
+
+	if myAmt-myFee < DustLimit || theirAmt-theirFee < DustLimit {
+		return nil, fmt.Errorf(
+			"SimpleCloseTx: fee %d at %d sat/vB leaves a dust output", fee, feeRate)
+	}
 
 	// get final elkrem points; both R, theirs and mine
 	theirElkPointR, err := q.ElkPoint(false, false, q.State.StateIdx)
@@ -38,10 +50,10 @@ func (q *Qchan) SimpleCloseTx() (*wire.MsgTx, error) {
 
 	// make my output
 	myScript := DirectWPKHScript(myRefundPub)
-	myOutput := wire.NewTxOut(q.State.MyAmt-fee, myScript)
+	myOutput := wire.NewTxOut(myAmt-myFee, myScript)
 	// make their output
 	theirScript := DirectWPKHScript(theirRefundPub)
-	theirOutput := wire.NewTxOut((q.Value-q.State.MyAmt)-fee, theirScript)
+	theirOutput := wire.NewTxOut(theirAmt-theirFee, theirScript)
 
 	// make tx with these outputs
 	tx := wire.NewMsgTx()
@@ -54,6 +66,50 @@ func (q *Qchan) SimpleCloseTx() (*wire.MsgTx, error) {
 	return tx, nil
 }
 
+// BumpCloseFee builds the cooperative close again at newFeeRate (via
+// SimpleCloseTx) and adds the channel's fee-bump anchor output,
+// q.AnchorOp / q.AnchorTxo, as an extra input, rather than renegotiating
+// channel state.  It's meant for a close that's stuck because feeRate has
+// risen since SimpleCloseTx was signed.  The anchor input pays for its own
+// added vsize at newFeeRate; the rest of the anchor value comes back in a
+// change output to the anchor's script if it's at least DustLimit.  The
+// returned tx is unsigned: no input, the channel input included, is
+// signed here, so every input needs signatures before broadcast.
+func BumpCloseFee(q *Qchan, newFeeRate int64) (*wire.MsgTx, error) {
+	if q == nil || q.State == nil {
+		return nil, fmt.Errorf("BumpCloseFee: nil chan / state")
+	}
+	if q.AnchorTxo.Value <= 0 {
+		return nil, fmt.Errorf("BumpCloseFee: channel has no fee-bump anchor")
+	}
+
+	tx, err := q.SimpleCloseTx(newFeeRate)
+	if err != nil {
+		return nil, err
+	}
+
+	// spend the anchor to cover the extra fee above what the two close
+	// outputs already gave up; anything left over comes back to us.
+	// sponsorInputVSize is the right shape here too -- one more P2WPKH
+	// input, one P2WPKH change output -- so reuse it instead of adding
+	// raw byte counts to an already-rounded vsize.
+	extraFee := sponsorInputVSize() * newFeeRate
+
+	change := q.AnchorTxo.Value - extraFee
+	if change < 0 {
+		return nil, fmt.Errorf(
+			"BumpCloseFee: anchor value %d too small for %d sat/vB bump",
+			q.AnchorTxo.Value, newFeeRate)
+	}
+
+	tx.AddTxIn(wire.NewTxIn(&q.AnchorOp, nil, nil))
+	if change >= DustLimit {
+		tx.AddTxOut(wire.NewTxOut(change, q.AnchorTxo.PkScript))
+	}
+	txsort.InPlaceSort(tx)
+	return tx, nil
+}
+
 // BuildStateTx constructs and returns a state tx.  As simple as I can make it.
 // This func just makes the tx with data from State in ram, and HAKD key arg
 // Delta should always be 0 when making this tx.
@@ -62,9 +118,11 @@ func (q *Qchan) SimpleCloseTx() (*wire.MsgTx, error) {
 // If it's full, it makes your transaction (for verification in most cases,
 // but also for signing when breaking the channel)
 // Index is used to set nlocktime for state hints.
-// fee and op_csv timeout are currently hardcoded, make those parameters later.
+// op_csv timeout is currently hardcoded, make that a parameter later.
+// feeRate is in sat/vByte; if it's <= 0, q.FeeEst is asked for a rate,
+// falling back to DefaultFeeRate if that's unset or errors.
 // also returns the script preimage for later spending.
-func (q *Qchan) BuildStateTx(mine bool) (*wire.MsgTx, error) {
+func (q *Qchan) BuildStateTx(mine bool, feeRate int64) (*wire.MsgTx, error) {
 	if q == nil {
 		return nil, fmt.Errorf("BuildStateTx: nil chan")
 	}
@@ -81,16 +139,30 @@ func (q *Qchan) BuildStateTx(mine bool) (*wire.MsgTx, error) {
 	var fancyAmt, pkhAmt int64   // output amounts
 	var revPub, timePub [33]byte // pubkeys
 	var pkhPub [33]byte          // the simple output's pub key hash
-	fee := int64(5000)           // fixed fee for now
-	delay := uint16(5)           // fixed CSV delay for now
+	feeRate = q.feeRateOrDefault(feeRate)
+	outputBytes := int64(p2wshOutSize+p2wpkhOutSize) + int64(len(s.HTLCs))*p2wshOutSize
+	fee := q.txVSize(outputBytes) * feeRate
+	delay := uint16(5) // fixed CSV delay for now
 	// delay is super short for testing.
 
+	myFee, theirFee := splitFee(fee, s.MyAmt, q.Value-s.MyAmt)
+	if s.MyAmt-myFee < DustLimit || (q.Value-s.MyAmt)-theirFee < DustLimit {
+		return nil, fmt.Errorf(
+			"BuildStateTx: fee %d at %d sat/vB leaves a dust output", fee, feeRate)
+	}
+
 	// Both received and self-generated elkpoints are needed
 	// Here generate the elk point we give them (we know the scalar; they don't)
 	theirElkPointR, theirElkPointT, err := q.MakeTheirCurElkPoints()
 	if err != nil {
 		return nil, err
 	}
+	// HTLC refund pubkeys are masked with the same elkrem points as the
+	// PKH output, computed the same way regardless of whose tx this is
+	// (see SimpleCloseTx, which does the same thing unconditionally).
+	myHTLCPub := lnutil.AddPubs(q.MyRefundPub, theirElkPointR)
+	theirHTLCPub := lnutil.AddPubs(q.TheirRefundPub, s.ElkPointR)
+
 	// the PKH clear refund also has elkrem points added to mask the PKH.
 	// this changes the txouts at each state to blind sorceror better.
 	if mine { // build MY tx (to verify) (unless breaking)
@@ -100,8 +172,8 @@ func (q *Qchan) BuildStateTx(mine bool) (*wire.MsgTx, error) {
 		timePub = lnutil.AddPubs(q.MyHAKDBase, theirElkPointT)
 
 		pkhPub = lnutil.AddPubs(q.TheirRefundPub, s.ElkPointR) // my received elkpoint
-		pkhAmt = (q.Value - s.MyAmt) - fee
-		fancyAmt = s.MyAmt - fee
+		pkhAmt = (q.Value - s.MyAmt) - theirFee
+		fancyAmt = s.MyAmt - myFee
 
 		fmt.Printf("\t refund base %x, elkpointR %x\n", q.TheirRefundPub, s.ElkPointR)
 	} else { // build THEIR tx (to sign)
@@ -110,11 +182,11 @@ func (q *Qchan) BuildStateTx(mine bool) (*wire.MsgTx, error) {
 		// SH pubkeys are our base points plus the received elk point
 		revPub = lnutil.AddPubs(q.MyHAKDBase, s.ElkPointR)
 		timePub = lnutil.AddPubs(q.TheirHAKDBase, s.ElkPointT)
-		fancyAmt = (q.Value - s.MyAmt) - fee
+		fancyAmt = (q.Value - s.MyAmt) - theirFee
 
 		// PKH output
 		pkhPub = lnutil.AddPubs(q.MyRefundPub, theirElkPointR) // their (sent) elk point
-		pkhAmt = s.MyAmt - fee
+		pkhAmt = s.MyAmt - myFee
 		fmt.Printf("\trefund base %x, elkpointR %x\n", q.MyRefundPub, theirElkPointR)
 	}
 
@@ -141,6 +213,33 @@ func (q *Qchan) BuildStateTx(mine bool) (*wire.MsgTx, error) {
 	// add txouts
 	tx.AddTxOut(outFancy)
 	tx.AddTxOut(outPKH)
+
+	// one P2WSH output per HTLC, same revocation key and CSV delay as the
+	// fancy output above -- a breach gets punished the same way whether
+	// it steals the main balance or an in-flight HTLC.  The preimage and
+	// timeout branches use the elkrem-masked refund pubkeys from above.
+	htlcScripts := make([][]byte, len(s.HTLCs))
+	for i, h := range s.HTLCs {
+		if h.Amt < DustLimit {
+			return nil, fmt.Errorf(
+				"BuildStateTx: HTLC %d amount %d is below dust limit", h.Idx, h.Amt)
+		}
+		var htlcScript []byte
+		if h.Incoming {
+			htlcScript, err = receiverHTLCScript(
+				theirHTLCPub, revPub, myHTLCPub, h.RHash, h.Expiry, delay)
+		} else {
+			htlcScript, err = senderHTLCScript(
+				theirHTLCPub, revPub, myHTLCPub, h.RHash, h.Expiry, delay)
+		}
+		if err != nil {
+			return nil, err
+		}
+		htlcScript = P2WSHify(htlcScript)
+		htlcScripts[i] = htlcScript
+		tx.AddTxOut(wire.NewTxOut(h.Amt, htlcScript))
+	}
+
 	// add unsigned txin
 	tx.AddTxIn(wire.NewTxIn(&q.Op, nil, nil))
 	// set index hints
@@ -155,6 +254,10 @@ func (q *Qchan) BuildStateTx(mine bool) (*wire.MsgTx, error) {
 
 	// sort outputs
 	txsort.InPlaceSort(tx)
+
+	// record where each HTLC ended up post-sort
+	s.HTLCIdxs = htlcOutputIndices(tx, s.HTLCs, htlcScripts)
+
 	return tx, nil
 }
 
@@ -191,10 +294,20 @@ func CommitScript2(RKey, TKey [33]byte, delay uint16) ([]byte, error) {
 // Give it the two pubkeys and it'll give you the p2sh'd txout.
 // You don't have to remember the p2sh preimage, as long as you remember the
 // pubkeys involved.
-func FundTxOut(pubA, puB [33]byte, amt int64) (*wire.TxOut, error) {
+// aggregate picks FundTxScriptAggregate's single-key output over the
+// classic 2-of-2 OP_CHECKMULTISIG from FundTxScript.
+func FundTxOut(pubA, puB [33]byte, amt int64, aggregate bool) (*wire.TxOut, error) {
 	if amt < 0 {
 		return nil, fmt.Errorf("Can't create FundTx script with negative coins")
 	}
+	if aggregate {
+		scriptBytes, _, err := FundTxScriptAggregate(pubA, puB)
+		if err != nil {
+			return nil, err
+		}
+		return wire.NewTxOut(amt, scriptBytes), nil
+	}
+
 	scriptBytes, _, err := FundTxScript(pubA, puB)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,143 @@
+package qln
+
+import (
+	"fmt"
+)
+
+// DustLimit is the minimum value, in satoshis, we'll allow a cooperative
+// close or commitment output to have.  Outputs below this are
+// uneconomical to spend and get dropped by most relay policies, so we
+// refuse to build a state that would create one.
+var DustLimit = int64(546)
+
+// DefaultFeeRate is what we use when nobody has given us a better number
+// and a FeeEstimator isn't available or fails.
+var DefaultFeeRate = int64(80) // sat/vByte, picked conservatively
+
+// FeeEstimator supplies a fee rate, in satoshis per vbyte, to use when
+// building close and commitment transactions.  Qchan.FeeEst holds one of
+// these; SimpleCloseTx and BuildStateTx fall back to it whenever they're
+// called without an explicit fee rate.
+type FeeEstimator interface {
+	// EstimateFee returns a fee rate aimed at confirming within
+	// confTarget blocks.
+	EstimateFee(confTarget int32) (int64, error)
+}
+
+// StaticFeeEstimator always hands back the same rate.  It's the fallback
+// used when no chain-backed estimator is wired up, or when one errors
+// out.
+type StaticFeeEstimator struct {
+	SatPerVByte int64
+}
+
+// EstimateFee implements FeeEstimator.
+func (s *StaticFeeEstimator) EstimateFee(confTarget int32) (int64, error) {
+	if s == nil || s.SatPerVByte <= 0 {
+		return DefaultFeeRate, nil
+	}
+	return s.SatPerVByte, nil
+}
+
+// ChainFeeEstimator asks a connected chain backend (full node RPC, or a
+// mempool-aware SPV peer) for a fee estimate, falling back to Backup if
+// the query fails or comes back with something unusable.
+type ChainFeeEstimator struct {
+	// Query does the round trip to the backend.  It's a func field so
+	// this package doesn't need to import a full node's RPC client or
+	// the SPV mempool tracker to use either of them.
+	Query func(confTarget int32) (int64, error)
+
+	// Backup is consulted whenever Query is nil or fails.
+	Backup FeeEstimator
+}
+
+// EstimateFee implements FeeEstimator.
+func (c *ChainFeeEstimator) EstimateFee(confTarget int32) (int64, error) {
+	if c == nil {
+		return 0, fmt.Errorf("ChainFeeEstimator: nil estimator")
+	}
+	if c.Query != nil {
+		rate, err := c.Query(confTarget)
+		if err == nil && rate > 0 {
+			return rate, nil
+		}
+	}
+	if c.Backup != nil {
+		return c.Backup.EstimateFee(confTarget)
+	}
+	return 0, fmt.Errorf("ChainFeeEstimator: query failed, no backup set")
+}
+
+// feeRateOrDefault returns feeRate if it's usable, otherwise asks q's
+// FeeEstimator (if any) for one, and finally falls back to
+// DefaultFeeRate.
+func (q *Qchan) feeRateOrDefault(feeRate int64) int64 {
+	if feeRate > 0 {
+		return feeRate
+	}
+	if q != nil && q.FeeEst != nil {
+		rate, err := q.FeeEst.EstimateFee(6)
+		if err == nil && rate > 0 {
+			return rate
+		}
+	}
+	return DefaultFeeRate
+}
+
+// splitFee divides fee proportionally between two balances, amtA and
+// amtB, so the side with more money in the channel pays more of it.
+// Leftover satoshis from integer division go to A.
+func splitFee(fee, amtA, amtB int64) (feeA, feeB int64) {
+	total := amtA + amtB
+	if total <= 0 {
+		half := fee / 2
+		return fee - half, half
+	}
+	feeB = fee * amtB / total
+	return fee - feeB, feeB
+}
+
+// Rough size, in bytes (one weight unit each), of the witness needed to spend one of our
+// P2WSH commit/close-type outputs (2 stack sigs + redeem script), a
+// plain P2WPKH refund output (sig + pubkey), and a FundTxScriptAggregate
+// output (a single BIP340 signature, taproot key-path style).  These are
+// overestimates; better to overpay a little than build a tx that doesn't
+// relay.
+const (
+	p2wshSpendWitSize      = 222
+	p2wpkhWitSize          = 108
+	taprootKeySpendWitSize = 66
+)
+
+// Rough size, in bytes, of a single txout: value(8) + scriptlen(1) +
+// script.  p2wpkhOutSize covers the ~22-byte P2WPKH refund/change
+// outputs SimpleCloseTx and BuildStateTx's pkh output use; p2wshOutSize
+// covers the ~34-byte P2WSH outputs BuildStateTx uses for its fancy
+// output and for each HTLC.
+const (
+	p2wpkhOutSize = 31
+	p2wshOutSize  = 43
+)
+
+// txVSize estimates the virtual size of a 1-input segwit tx spending q's
+// funding outpoint, given the combined size of its outputs in bytes.
+// SimpleCloseTx spends into two p2wpkhOutSize outputs; BuildStateTx's
+// commitment tx spends into one p2wshOutSize fancy output, one
+// p2wpkhOutSize pkh output, and one p2wshOutSize output per in-flight
+// HTLC -- each caller passes in the sum that matches what it's actually
+// building.  An aggregate (FundTxScriptAggregate) funding output spends
+// with a single BIP340 signature, so it's charged the smaller
+// taprootKeySpendWitSize instead of the classic p2wshSpendWitSize.
+func (q *Qchan) txVSize(outputBytes int64) int64 {
+	// version(4) + incount(1) + outpoint(36) + scriptsiglen(1) +
+	// sequence(4) + outcount(1) + outputs + locktime(4)
+	baseSize := int64(4+1+36+1+4+1+4) + outputBytes
+	spendWit := int64(p2wshSpendWitSize)
+	if q != nil && q.AggregateFunding {
+		spendWit = int64(taprootKeySpendWitSize)
+	}
+	witSize := int64(2 + spendWit) // segwit marker+flag + stack
+	weight := baseSize*4 + witSize
+	return (weight + 3) / 4 // ceil(weight / 4), per BIP141
+}
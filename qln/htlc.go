@@ -0,0 +1,268 @@
+package qln
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/roasbeef/btcd/txscript"
+	"github.com/roasbeef/btcd/wire"
+	"golang.org/x/crypto/ripemd160"
+)
+
+// ripemd160Hash is a single round of RIPEMD160 over b, used to embed the
+// preimage-hash constant an HTLC script's OP_HASH160 (itself
+// RIPEMD160(SHA256(x))) checks a witness preimage against.
+func ripemd160Hash(b []byte) []byte {
+	h := ripemd160.New()
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// HTLC describes a single in-flight HTLC carried in a channel's state.
+// BuildStateTx appends one P2WSH output per HTLC to the commitment tx it
+// builds, using senderHTLCScript / receiverHTLCScript depending on
+// Incoming.  Like the main commitment outputs, the script's revocation
+// key is just the state's existing revPub, and its preimage and timeout
+// keys are the two refund pubkeys masked with the state's existing elkrem
+// points -- HTLCs don't need their own elkrem points.
+type HTLC struct {
+	Idx uint32 // position among this state's HTLCs; used for output bookkeeping
+
+	Amt    int64    // value of the HTLC, in satoshis
+	RHash  [32]byte // hash of the payment preimage
+	Expiry int32    // CLTV absolute locktime the sender can reclaim after
+	// Incoming is true if we're the receiver of this HTLC (someone
+	// routed a payment to us through this channel), false if we're the
+	// sender (we're routing a payment out through this channel).
+	Incoming bool
+}
+
+// senderHTLCScript is the output script for an HTLC that we (or our
+// channel counterparty, when building their tx) sent.  It can be spent
+// three ways:
+//
+//	(a) the receiver, with the payment preimage
+//	(b) either party, with the revocation key (breach remedy)
+//	(c) the sender, after the OP_CSV delay and the CLTV expiry, to
+//	    reclaim the HTLC if it was never fulfilled
+//
+// Which branch applies is picked entirely by witness-supplied flags, not
+// by which signature happens to verify: a top-level flag selects
+// revocation vs. not (branch (b) can't be told apart from (a)/(c) by a
+// CHECKSIG's success/failure -- the sig for the "wrong" branch is a
+// real, non-empty signature under a different key, and BIP146 NULLFAIL
+// forbids a script from ever relying on such a signature failing), and
+// within the non-revocation path, OP_SIZE on the preimage-or-empty
+// witness item picks (a) over (c): 32 bytes means it's a preimage,
+// anything else means it's not.  This mirrors how real BOLT3 HTLC
+// scripts disambiguate the same branches.
+func senderHTLCScript(receiverPub, revPub, senderPub [33]byte,
+	payHash [32]byte, cltvExpiry int32, delay uint16) ([]byte, error) {
+
+	builder := txscript.NewScriptBuilder()
+
+	builder.AddOp(txscript.OP_IF)
+
+	// (b) revocation branch -- drop the unused preimage slot and check
+	// the one sig we do have against revPub.
+	builder.AddOp(txscript.OP_SWAP)
+	builder.AddOp(txscript.OP_DROP)
+	builder.AddData(revPub[:])
+	builder.AddOp(txscript.OP_CHECKSIG)
+
+	builder.AddOp(txscript.OP_ELSE)
+
+	// bring the preimage-or-empty witness item to the top and test its
+	// length to tell (a) and (c) apart.
+	builder.AddOp(txscript.OP_SWAP)
+	builder.AddOp(txscript.OP_SIZE)
+	builder.AddInt64(32)
+	builder.AddOp(txscript.OP_EQUAL)
+	builder.AddOp(txscript.OP_IF)
+
+	// (a) receiver + preimage
+	builder.AddOp(txscript.OP_HASH160)
+	builder.AddData(ripemd160Hash(payHash[:]))
+	builder.AddOp(txscript.OP_EQUALVERIFY)
+	builder.AddData(receiverPub[:])
+	builder.AddOp(txscript.OP_CHECKSIG)
+
+	builder.AddOp(txscript.OP_ELSE)
+
+	// (c) sender, after CSV delay + CLTV expiry
+	builder.AddOp(txscript.OP_DROP) // drop the (empty) preimage slot
+	builder.AddInt64(int64(cltvExpiry))
+	builder.AddOp(txscript.OP_CHECKLOCKTIMEVERIFY)
+	builder.AddOp(txscript.OP_DROP)
+	builder.AddInt64(int64(delay))
+	builder.AddOp(txscript.OP_CHECKSEQUENCEVERIFY)
+	builder.AddOp(txscript.OP_DROP)
+	builder.AddData(senderPub[:])
+	builder.AddOp(txscript.OP_CHECKSIG)
+
+	builder.AddOp(txscript.OP_ENDIF)
+	builder.AddOp(txscript.OP_ENDIF)
+
+	return builder.Script()
+}
+
+// receiverHTLCScript is the mirror of senderHTLCScript for an HTLC we (or
+// our counterparty) received: same three spend paths, roles swapped.
+func receiverHTLCScript(senderPub, revPub, receiverPub [33]byte,
+	payHash [32]byte, cltvExpiry int32, delay uint16) ([]byte, error) {
+
+	builder := txscript.NewScriptBuilder()
+
+	builder.AddOp(txscript.OP_IF)
+
+	// (b) revocation branch
+	builder.AddOp(txscript.OP_SWAP)
+	builder.AddOp(txscript.OP_DROP)
+	builder.AddData(revPub[:])
+	builder.AddOp(txscript.OP_CHECKSIG)
+
+	builder.AddOp(txscript.OP_ELSE)
+
+	builder.AddOp(txscript.OP_SWAP)
+	builder.AddOp(txscript.OP_SIZE)
+	builder.AddInt64(32)
+	builder.AddOp(txscript.OP_EQUAL)
+	builder.AddOp(txscript.OP_IF)
+
+	// (a) receiver + preimage
+	builder.AddOp(txscript.OP_HASH160)
+	builder.AddData(ripemd160Hash(payHash[:]))
+	builder.AddOp(txscript.OP_EQUALVERIFY)
+	builder.AddData(receiverPub[:])
+	builder.AddOp(txscript.OP_CHECKSIG)
+
+	builder.AddOp(txscript.OP_ELSE)
+
+	// (c) sender, after CSV delay + CLTV expiry
+	builder.AddOp(txscript.OP_DROP) // drop the (empty) preimage slot
+	builder.AddInt64(int64(cltvExpiry))
+	builder.AddOp(txscript.OP_CHECKLOCKTIMEVERIFY)
+	builder.AddOp(txscript.OP_DROP)
+	builder.AddInt64(int64(delay))
+	builder.AddOp(txscript.OP_CHECKSEQUENCEVERIFY)
+	builder.AddOp(txscript.OP_DROP)
+	builder.AddData(senderPub[:])
+	builder.AddOp(txscript.OP_CHECKSIG)
+
+	builder.AddOp(txscript.OP_ENDIF)
+	builder.AddOp(txscript.OP_ENDIF)
+
+	return builder.Script()
+}
+
+// SpendHTLCRevokeWitStack builds the witness stack that punishes a
+// breach by spending an HTLC output with the revocation key.  The
+// preimage slot is never inspected on this path, so it's left empty;
+// the selector item is pushed non-empty to steer the script into the
+// revocation branch.
+func SpendHTLCRevokeWitStack(pre, sig []byte) [][]byte {
+	witStack := make([][]byte, 4)
+	witStack[0] = nil // unused preimage slot
+	witStack[1] = sig
+	witStack[2] = []byte{1} // select the revocation branch
+	witStack[3] = pre
+	return witStack
+}
+
+// SpendHTLCPreimageWitStack builds the witness stack that spends an HTLC
+// output via the receiver + preimage branch.  preimage must be exactly
+// 32 bytes -- that's what the script's OP_SIZE check keys off of to
+// pick this branch over the timeout branch.  The selector item is left
+// empty to steer the script past the revocation branch.
+func SpendHTLCPreimageWitStack(pre, sig, preimage []byte) [][]byte {
+	witStack := make([][]byte, 4)
+	witStack[0] = preimage
+	witStack[1] = sig
+	witStack[2] = nil // select the non-revocation branch
+	witStack[3] = pre
+	return witStack
+}
+
+// SpendHTLCTimeoutWitStack builds the witness stack that spends an HTLC
+// output via the sender/receiver CSV+CLTV timeout branch.  The preimage
+// slot must be empty so the script's OP_SIZE check steers into this
+// branch instead of the preimage one, and the selector item is left
+// empty to steer past the revocation branch.
+func SpendHTLCTimeoutWitStack(pre, sig []byte) [][]byte {
+	witStack := make([][]byte, 4)
+	witStack[0] = nil // empty -- not a 32-byte preimage
+	witStack[1] = sig
+	witStack[2] = nil // select the non-revocation branch
+	witStack[3] = pre
+	return witStack
+}
+
+// htlcSecondStageVSize estimates the vsize of a second-stage HTLC
+// success/timeout tx: one input spending an HTLC output, one output
+// paying into CommitScript2.
+func htlcSecondStageVSize() int64 {
+	baseSize := int64(4 + 1 + 36 + 1 + 4 + 1 + 43 + 4)
+	witSize := int64(2 + p2wshSpendWitSize)
+	weight := baseSize*4 + witSize
+	return (weight + 3) / 4
+}
+
+// BuildHTLCSuccessTx spends a received HTLC output using the payment
+// preimage, into a second-stage output locked with CommitScript2 -- the
+// same revocation+delay script the main commitment outputs use -- so a
+// breach of this tx can be punished exactly like a breach of the
+// commitment tx itself.
+func BuildHTLCSuccessTx(htlcOp wire.OutPoint, htlcAmt, feeRate int64,
+	revPub, timePub [33]byte, delay uint16) (*wire.MsgTx, []byte, error) {
+
+	script, err := CommitScript2(revPub, timePub, delay)
+	if err != nil {
+		return nil, nil, err
+	}
+	fee := htlcSecondStageVSize() * feeRate
+	if htlcAmt-fee < DustLimit {
+		return nil, nil, fmt.Errorf(
+			"BuildHTLCSuccessTx: fee %d at %d sat/vB leaves a dust output", fee, feeRate)
+	}
+
+	tx := wire.NewMsgTx()
+	tx.AddTxIn(wire.NewTxIn(&htlcOp, nil, nil))
+	tx.AddTxOut(wire.NewTxOut(htlcAmt-fee, P2WSHify(script)))
+	return tx, script, nil
+}
+
+// BuildHTLCTimeoutTx is BuildHTLCSuccessTx's counterpart for an offered
+// HTLC that was never fulfilled: it spends the HTLC output after its
+// CLTV expiry into the same CommitScript2-locked second-stage output.
+func BuildHTLCTimeoutTx(htlcOp wire.OutPoint, htlcAmt, feeRate int64,
+	cltvExpiry int32, revPub, timePub [33]byte, delay uint16) (*wire.MsgTx, []byte, error) {
+
+	tx, script, err := BuildHTLCSuccessTx(htlcOp, htlcAmt, feeRate, revPub, timePub, delay)
+	if err != nil {
+		return nil, nil, err
+	}
+	tx.LockTime = uint32(cltvExpiry)
+	// the timeout branch runs both CLTV and CSV: CSV needs tx version 2
+	// and the delay in the input's sequence, and a non-final sequence is
+	// also what lets LockTime (and so CLTV) take effect.
+	tx.Version = 2
+	tx.TxIn[0].Sequence = uint32(delay)
+	return tx, script, nil
+}
+
+// htlcOutputIndices returns, after txsort.InPlaceSort has run, the
+// output index of each HTLC output in tx, keyed by HTLC.Idx.  Callers
+// use this instead of re-deriving scripts to find where each HTLC ended
+// up post-sort, the same role SetStateIdxBits plays for the state index
+// hint.
+func htlcOutputIndices(tx *wire.MsgTx, htlcs []HTLC, scripts [][]byte) map[uint32]int {
+	found := make(map[uint32]int)
+	for i, txout := range tx.TxOut {
+		for j, script := range scripts {
+			if bytes.Equal(txout.PkScript, script) {
+				found[htlcs[j].Idx] = i
+			}
+		}
+	}
+	return found
+}
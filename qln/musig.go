@@ -0,0 +1,249 @@
+package qln
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+
+	"github.com/btcsuite/fastsha256"
+	"github.com/lightningnetwork/lnd/lnutil"
+	"github.com/roasbeef/btcd/btcec"
+	"github.com/roasbeef/btcd/txscript"
+)
+
+// AggregatePubkey returns Q = A + B + H(A||B)*G, the single key that
+// spends a FundTxScriptAggregate output.
+func AggregatePubkey(aPub, bPub [33]byte) ([33]byte, error) {
+	tweakPub, err := aggregateTweakPoint(aPub, bPub)
+	if err != nil {
+		return [33]byte{}, err
+	}
+	return lnutil.AddPubs(lnutil.AddPubs(aPub, bPub), tweakPub), nil
+}
+
+// FundTxScriptAggregate builds the aggregated pubkey Q = A + B + H(A||B)*G
+// out of the two funding pubkeys, and returns a segwit v1 (taproot
+// key-path) output paying to it, along with Q itself.  Unlike
+// FundTxScript's 2-of-2 OP_CHECKMULTISIG, a transaction funded this way
+// is spent with a single BIP340-style signature -- which means it has to
+// be verified as one, not run through legacy OP_CHECKSIG against a
+// P2WPKH program (an ECDSA check, algebraically incompatible with the
+// additive combination AggMusigSign/CombineAggMusigSigShares produce). A
+// bare P2WPKH-equivalent script was the original ask here, but
+// AggMusigSign's s = k + e*x combination is a Schnorr-style scheme and
+// was never going to verify against ECDSA OP_CHECKSIG regardless of what
+// the output script looked like; a plain witness v1 program is the
+// closest thing to "an output type that actually supports Schnorr
+// verification" available pre-activation: nodes that don't enforce
+// BIP341 treat an unknown witness version as always-valid, and nodes
+// that do enforce it validate the real signature -- so this only
+// becomes spendable as intended once BIP341 activates, rather than
+// being silently broken the way bare P2WPKH was.
+func FundTxScriptAggregate(aPub, bPub [33]byte) ([]byte, [33]byte, error) {
+	q, err := AggregatePubkey(aPub, bPub)
+	if err != nil {
+		return nil, q, err
+	}
+	return taprootKeyScript(q), q, nil
+}
+
+// taprootKeyScript builds a BIP341 key-path output: witness version 1
+// pushing the 32-byte x-only coordinate of pub.  The y-parity byte isn't
+// part of the program -- by convention the spender always signs for the
+// even-y point sharing that x, which is what needsNegation accounts for.
+func taprootKeyScript(pub [33]byte) []byte {
+	builder := txscript.NewScriptBuilder()
+	builder.AddOp(txscript.OP_1)
+	builder.AddData(pub[1:33])
+	b, _ := builder.Script()
+	return b
+}
+
+// needsNegation reports whether pub's y-coordinate is odd, per its
+// compressed-form parity byte.  BIP340 always signs for the even-y point
+// sharing an x-only pubkey's x-coordinate, so a party must negate its
+// scalar contribution whenever the point it's contributing to came out
+// odd -- this gets checked against the aggregate pubkey and, separately,
+// against the joint nonce.
+func needsNegation(pub [33]byte) bool {
+	return pub[0] == 0x03
+}
+
+// aggregateTweakScalar returns H(aPub||bPub) mod N, the scalar tweak
+// added to the aggregate pubkey (as a point) and to one party's signing
+// share (as a scalar) to get Q = A + B + tweak*G.
+func aggregateTweakScalar(aPub, bPub [33]byte) (*big.Int, error) {
+	h := fastsha256.Sum256(append(aPub[:], bPub[:]...))
+	d := new(big.Int).SetBytes(h[:])
+	d.Mod(d, btcec.S256().N)
+	if d.Sign() == 0 {
+		return nil, fmt.Errorf("aggregateTweakScalar: degenerate tweak")
+	}
+	return d, nil
+}
+
+// aggregateTweakPoint returns H(aPub||bPub)*G, the point form of
+// aggregateTweakScalar that FundTxScriptAggregate adds to A+B.
+func aggregateTweakPoint(aPub, bPub [33]byte) ([33]byte, error) {
+	var tweakPub [33]byte
+
+	d, err := aggregateTweakScalar(aPub, bPub)
+	if err != nil {
+		return tweakPub, err
+	}
+
+	_, pub := btcec.PrivKeyFromBytes(btcec.S256(), d.Bytes())
+	copy(tweakPub[:], pub.SerializeCompressed())
+	return tweakPub, nil
+}
+
+// SpendMultiSigWitStackAggregate is SpendMultiSigWitStack's counterpart
+// for a FundTxScriptAggregate output: a taproot key-path spend's witness
+// is just the signature -- the pubkey is already committed to in the
+// output's script, so it doesn't need to be revealed again.
+func SpendMultiSigWitStackAggregate(combinedSig []byte) [][]byte {
+	return [][]byte{combinedSig}
+}
+
+// AggMusigNonce is one party's half of the 2-round nonce exchange used
+// to jointly sign for a FundTxScriptAggregate output.  A fresh nonce
+// must be generated for every signature; reusing one against the same
+// key leaks the private key.
+type AggMusigNonce struct {
+	k *big.Int // secret nonce scalar -- never transmitted
+	R [33]byte // public nonce k*G -- sent to the other party
+}
+
+// NewAggMusigNonce generates a fresh nonce pair for round 1 of the
+// signing session.
+func NewAggMusigNonce() (*AggMusigNonce, error) {
+	curve := btcec.S256()
+	k, err := rand.Int(rand.Reader, curve.N)
+	if err != nil {
+		return nil, fmt.Errorf("NewAggMusigNonce: %s", err)
+	}
+
+	var R [33]byte
+	_, pub := btcec.PrivKeyFromBytes(curve, k.Bytes())
+	copy(R[:], pub.SerializeCompressed())
+
+	return &AggMusigNonce{k: k, R: R}, nil
+}
+
+// CombineNonces is round 2: once both parties have sent their R_i, each
+// combines them into the session's joint nonce R = R_1 + R_2.
+func CombineNonces(myR, theirR [33]byte) [33]byte {
+	return lnutil.AddPubs(myR, theirR)
+}
+
+// AggMusigSign produces this party's signature share toward the combined
+// BIP340-style signature s = k + e*x for a FundTxScriptAggregate spend.
+// aPub/bPub are the two funding pubkeys in the same order passed to
+// FundTxScriptAggregate/AggregatePubkey; isA says whether privKey is the
+// one behind aPub -- the party whose share carries the aggregate tweak,
+// since the tweak has to land on exactly one side or it'd be double
+// counted once the shares are summed. jointR is this session's combined
+// nonce from CombineNonces, and msgHash is the sighash being signed.
+func AggMusigSign(nonce *AggMusigNonce, privKey *btcec.PrivateKey, aPub, bPub [33]byte,
+	isA bool, jointR [33]byte, msgHash [32]byte) ([32]byte, error) {
+
+	var sShare [32]byte
+	if nonce == nil || nonce.k == nil {
+		return sShare, fmt.Errorf("AggMusigSign: nil nonce")
+	}
+
+	aggregatePub, err := AggregatePubkey(aPub, bPub)
+	if err != nil {
+		return sShare, err
+	}
+
+	curve := btcec.S256()
+	x := new(big.Int).SetBytes(privKey.Serialize())
+	if isA {
+		tweak, err := aggregateTweakScalar(aPub, bPub)
+		if err != nil {
+			return sShare, err
+		}
+		x.Add(x, tweak)
+		x.Mod(x, curve.N)
+	}
+
+	// BIP340 always signs for the even-y point sharing Q's (or R's)
+	// x-coordinate, so negate our scalar contribution whenever the
+	// point we actually computed came out odd.
+	if needsNegation(aggregatePub) {
+		x.Sub(curve.N, x)
+	}
+	k := new(big.Int).Set(nonce.k)
+	if needsNegation(jointR) {
+		k.Sub(curve.N, k)
+	}
+
+	e := aggMusigChallenge(jointR, aggregatePub, msgHash)
+	s := new(big.Int).Mul(e, x)
+	s.Add(s, k)
+	s.Mod(s, curve.N)
+
+	sBytes := s.Bytes()
+	copy(sShare[32-len(sBytes):], sBytes)
+	return sShare, nil
+}
+
+// CombineAggMusigSigShares combines both parties' signature shares into
+// the final s = s_1 + s_2.
+func CombineAggMusigSigShares(myShare, theirShare [32]byte) [32]byte {
+	curve := btcec.S256()
+
+	s := new(big.Int).Add(
+		new(big.Int).SetBytes(myShare[:]),
+		new(big.Int).SetBytes(theirShare[:]))
+	s.Mod(s, curve.N)
+
+	var combined [32]byte
+	sBytes := s.Bytes()
+	copy(combined[32-len(sBytes):], sBytes)
+	return combined
+}
+
+// FinalizeAggMusigSig assembles the final 64-byte BIP340 signature
+// (R_x || s) from the joint nonce and the combined signature scalar,
+// ready to push via SpendMultiSigWitStackAggregate.
+func FinalizeAggMusigSig(jointR [33]byte, combinedS [32]byte) []byte {
+	sig := make([]byte, 64)
+	copy(sig[:32], jointR[1:33])
+	copy(sig[32:], combinedS[:])
+	return sig
+}
+
+// taggedHash computes BIP340's tagged hash construction,
+// SHA256(SHA256(tag) || SHA256(tag) || msg) -- domain-separating a hash
+// so it can't collide with a differently-tagged hash over the same
+// bytes.  SHA256(tag) and the tag prefix are hashed again on every call.
+func taggedHash(tag string, msg []byte) [32]byte {
+	tagHash := fastsha256.Sum256([]byte(tag))
+	h := fastsha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	h.Write(msg)
+
+	var out [32]byte
+	copy(out[:], h.Sum(nil))
+	return out
+}
+
+// aggMusigChallenge computes e = H(R||Q||m) mod N, the challenge scalar
+// both parties use to compute their signature share.  Only the x-only
+// coordinates of R and Q go into the hash, per BIP340 -- the parity
+// bytes needsNegation checks aren't part of what the signature commits
+// to.  The hash itself has to be the "BIP0340/challenge" tagged hash, not
+// a plain SHA256 with the tag prefixed on: any standards-compliant
+// verifier computes e the tagged way, and a mismatched e here means
+// s*G != R + e*Q for every signature this produces.
+func aggMusigChallenge(jointR, aggregatePub [33]byte, msgHash [32]byte) *big.Int {
+	msg := append(append(
+		append([]byte{}, jointR[1:33]...),
+		aggregatePub[1:33]...), msgHash[:]...)
+	h := taggedHash("BIP0340/challenge", msg)
+	e := new(big.Int).SetBytes(h[:])
+	return e.Mod(e, btcec.S256().N)
+}
@@ -0,0 +1,120 @@
+package qln
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/roasbeef/btcd/txscript"
+	"github.com/roasbeef/btcd/wire"
+)
+
+// PartialTx is a PSBT-style interchange object: an unsigned tx plus
+// everything needed to sign and verify it (previous output scripts,
+// input values for BIP143 sighashing -- external doc 1 -- and the
+// funding redeem script), plus a slot for each party's signature.  It
+// lets the protocol layer pass a single serializable object across the
+// wire during close negotiation instead of hand-marshaling signatures
+// out of band.
+type PartialTx struct {
+	Tx *wire.MsgTx // the unsigned tx
+
+	PrevScripts  []byte // previous output pkScript for the funding input
+	InputValue   int64  // previous output value for the funding input
+	RedeemScript []byte // the funding redeem script from FundTxScript
+
+	Sigs map[[33]byte][]byte // partial witness sigs, keyed by signer pubkey
+}
+
+// SimpleCloseTxPartial is SimpleCloseTx, wrapped with the signing
+// metadata needed to hand the result to a counterparty over the wire.
+func (q *Qchan) SimpleCloseTxPartial(feeRate int64) (*PartialTx, error) {
+	tx, err := q.SimpleCloseTx(feeRate)
+	if err != nil {
+		return nil, err
+	}
+	return q.wrapPartialTx(tx), nil
+}
+
+// BuildStateTxPartial is BuildStateTx, wrapped with the signing metadata
+// needed to hand the result to a counterparty over the wire.
+func (q *Qchan) BuildStateTxPartial(mine bool, feeRate int64) (*PartialTx, error) {
+	tx, err := q.BuildStateTx(mine, feeRate)
+	if err != nil {
+		return nil, err
+	}
+	return q.wrapPartialTx(tx), nil
+}
+
+func (q *Qchan) wrapPartialTx(tx *wire.MsgTx) *PartialTx {
+	return &PartialTx{
+		Tx:           tx,
+		PrevScripts:  P2WSHify(q.RedeemScript),
+		InputValue:   q.Value,
+		RedeemScript: q.RedeemScript,
+		Sigs:         make(map[[33]byte][]byte),
+	}
+}
+
+// AddSignature records pub's partial witness signature for the funding
+// input.  Once both parties' signatures have been added, Finalize can
+// assemble the final witness.
+func (p *PartialTx) AddSignature(pub [33]byte, sig []byte) error {
+	if p == nil || p.Tx == nil {
+		return fmt.Errorf("PartialTx.AddSignature: nil partial tx")
+	}
+	if p.Sigs == nil {
+		p.Sigs = make(map[[33]byte][]byte)
+	}
+	p.Sigs[pub] = sig
+	return nil
+}
+
+// Finalize assembles the final witness for the funding input via
+// SpendMultiSigWitStack, sorting the two signatures to match the
+// pubkey order FundTxScript used when it built RedeemScript.
+func (p *PartialTx) Finalize() (*wire.MsgTx, error) {
+	if p == nil || p.Tx == nil {
+		return nil, fmt.Errorf("PartialTx.Finalize: nil partial tx")
+	}
+	if len(p.Sigs) != 2 {
+		return nil, fmt.Errorf(
+			"PartialTx.Finalize: need 2 signatures, have %d", len(p.Sigs))
+	}
+
+	var pubs [][33]byte
+	for pub := range p.Sigs {
+		pubs = append(pubs, pub)
+	}
+	aPub, bPub := pubs[0], pubs[1]
+	if bytes.Compare(aPub[:], bPub[:]) == -1 { // same sort FundTxScript uses
+		aPub, bPub = bPub, aPub
+	}
+
+	final := p.Tx.Copy()
+	final.TxIn[0].Witness = SpendMultiSigWitStack(
+		p.RedeemScript, p.Sigs[aPub], p.Sigs[bPub])
+	return final, nil
+}
+
+// Verify finalizes the tx and runs it through a txscript.NewEngine
+// (external doc 11) with StandardVerifyFlags and a TxSigHashes cache,
+// to make sure both signatures actually satisfy RedeemScript before
+// it's broadcast.
+func (p *PartialTx) Verify() error {
+	final, err := p.Finalize()
+	if err != nil {
+		return err
+	}
+
+	hashes := txscript.NewTxSigHashes(final)
+	engine, err := txscript.NewEngine(
+		p.PrevScripts, final, 0, txscript.StandardVerifyFlags, nil,
+		hashes, p.InputValue)
+	if err != nil {
+		return fmt.Errorf("PartialTx.Verify: %s", err)
+	}
+	if err := engine.Execute(); err != nil {
+		return fmt.Errorf("PartialTx.Verify: %s", err)
+	}
+	return nil
+}
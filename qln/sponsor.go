@@ -0,0 +1,144 @@
+package qln
+
+import (
+	"fmt"
+
+	"github.com/roasbeef/btcd/btcec"
+	"github.com/roasbeef/btcd/txscript"
+	"github.com/roasbeef/btcd/wire"
+)
+
+// Utxo is a minimal wallet output: just enough to add it as an extra
+// input and sign for it.
+type Utxo struct {
+	Op       wire.OutPoint
+	Value    int64
+	PkScript []byte
+	PrivKey  *btcec.PrivateKey
+}
+
+// sponsorInputVSize is the vsize one sponsor input + its change output
+// add to a tx: one P2WPKH input, one P2WPKH output.
+func sponsorInputVSize() int64 {
+	const inSize = 41  // outpoint(36) + scriptsiglen(1) + sequence(4)
+	const outSize = 31 // value(8) + scriptlen(1) + p2wpkh script(22)
+	weight := (inSize+outSize)*4 + int64(p2wpkhWitSize)
+	return (weight + 3) / 4
+}
+
+// pickSponsorUTXO finds the smallest wallet utxo big enough to cover its
+// own added fee at feeRate, so sponsoring doesn't tie up more coin than
+// it needs to.
+func pickSponsorUTXO(utxos []Utxo, feeRate int64) (Utxo, error) {
+	need := sponsorInputVSize()*feeRate + DustLimit
+	best := -1
+	for i, u := range utxos {
+		if u.Value <= need {
+			continue
+		}
+		if best == -1 || u.Value < utxos[best].Value {
+			best = i
+		}
+	}
+	if best == -1 {
+		return Utxo{}, fmt.Errorf(
+			"SponsorSpend: no wallet utxo large enough to sponsor at %d sat/vB", feeRate)
+	}
+	return utxos[best], nil
+}
+
+// SponsorSpend attaches an extra wallet input and change output to an
+// unsigned commitTx -- a cooperative close, a commitment, or a justice
+// tx built from Qchan.BuildStateTx(true) -- so it can be broadcast with
+// an extra sponsor input paying at feeRate, without renegotiating
+// anything the channel parties agreed to.  The fee the sponsor adds is
+// sponsorInputVSize() * feeRate: it pays for the sponsor input and change
+// output alone, and the rest of commitTx keeps the fee it was built with.  commitTx's own inputs must still be unsigned when this is called:
+// the channel parties' SigHashAll signatures commit to every output via
+// hashOutputs, so inserting the change output after the fact would
+// invalidate them.  Only the new sponsor input is signed here, with
+// SigHashSingle|SigHashAnyOneCanPay (external doc 6) -- the parties sign
+// the rest of the tx, sponsor input and change output included, once
+// this function has added them.
+func SponsorSpend(commitTx *wire.MsgTx, walletUTXOs []Utxo, feeRate int64) (*wire.MsgTx, error) {
+	if commitTx == nil || len(commitTx.TxIn) == 0 {
+		return nil, fmt.Errorf("SponsorSpend: nil or inputless commitTx")
+	}
+	for _, in := range commitTx.TxIn {
+		if len(in.Witness) != 0 {
+			return nil, fmt.Errorf(
+				"SponsorSpend: commitTx already has a witness on %s -- "+
+					"sponsor before signing, not after; inserting an "+
+					"output here would invalidate an existing SigHashAll signature",
+				in.PreviousOutPoint.String())
+		}
+	}
+
+	utxo, err := pickSponsorUTXO(walletUTXOs, feeRate)
+	if err != nil {
+		return nil, err
+	}
+
+	sponsored := commitTx.Copy()
+
+	// SigHashSingle commits to the output at the same index as the
+	// input being signed, so the sponsor input and its change output
+	// have to land at the same index -- not just get appended
+	// independently, which only lines up by coincidence when the
+	// original tx already has equal input and output counts. Inputs are
+	// only ever appended, so commitTx's own inputs keep their indexes, and
+	// the change output is inserted at the new input's index instead of
+	// tacked onto the end.  A commitTx with more inputs than outputs has
+	// no output slot at that index, so it's refused.
+	sponsored.AddTxIn(wire.NewTxIn(&utxo.Op, nil, nil))
+	sponsorInIdx := len(sponsored.TxIn) - 1
+	if sponsorInIdx > len(sponsored.TxOut) {
+		return nil, fmt.Errorf(
+			"SponsorSpend: commitTx has %d inputs but only %d outputs; "+
+				"change output can't land at the sponsor input's index",
+			len(commitTx.TxIn), len(commitTx.TxOut))
+	}
+
+	changeOut := wire.NewTxOut(0, utxo.PkScript) // value filled in below
+	if sponsorInIdx >= len(sponsored.TxOut) {
+		sponsored.AddTxOut(changeOut)
+	} else {
+		sponsored.TxOut = append(sponsored.TxOut, nil)
+		copy(sponsored.TxOut[sponsorInIdx+1:], sponsored.TxOut[sponsorInIdx:])
+		sponsored.TxOut[sponsorInIdx] = changeOut
+	}
+	changeIdx := sponsorInIdx
+
+	fee := sponsorInputVSize() * feeRate
+	change := utxo.Value - fee
+	if change < DustLimit {
+		return nil, fmt.Errorf(
+			"SponsorSpend: utxo %s too small to cover %d sat/vB fee",
+			utxo.Op.String(), feeRate)
+	}
+	sponsored.TxOut[changeIdx].Value = change
+
+	hashes := txscript.NewTxSigHashes(sponsored)
+	sig, err := txscript.RawTxInWitnessSignature(
+		sponsored, hashes, sponsorInIdx, utxo.Value, utxo.PkScript,
+		txscript.SigHashSingle|txscript.SigHashAnyOneCanPay, utxo.PrivKey)
+	if err != nil {
+		return nil, fmt.Errorf("SponsorSpend: signing sponsor input: %s", err)
+	}
+	sponsored.TxIn[sponsorInIdx].Witness = wire.TxWitness{
+		sig, utxo.PrivKey.PubKey().SerializeCompressed(),
+	}
+
+	return sponsored, nil
+}
+
+// SponsorJusticeTx is SponsorSpend specialized for the breach-remedy
+// path: a justice tx built from Qchan.BuildStateTx(true) that claims a
+// cheating counterparty's revoked commitment outputs.  Justice txs are
+// often broadcast well after they're built, so the fee rate picked at
+// build time can easily be stale by the time they're needed; sponsoring
+// before signing lets us add a CPFP-style input at the current rate
+// without renegotiating the breach-remedy witness itself.
+func SponsorJusticeTx(justiceTx *wire.MsgTx, walletUTXOs []Utxo, feeRate int64) (*wire.MsgTx, error) {
+	return SponsorSpend(justiceTx, walletUTXOs, feeRate)
+}